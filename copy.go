@@ -0,0 +1,38 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+)
+
+// copyBuffer relays src to dst using a pooled buffer from GetBuffer/PutBuffer
+// instead of the ad-hoc buffer io.Copy would otherwise allocate, avoiding a
+// per-connection allocation on platforms without a splice fast path.
+func copyBuffer(dst, src net.Conn) (int64, error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+	return io.CopyBuffer(dst, src, buf)
+}
+
+// relayConn copies src to dst, preferring the Linux splice fast path when
+// both ends are plain TCP connections and falling back to copyBuffer
+// otherwise (non-Linux builds, or either end wrapped by a ConnMiddleware).
+func relayConn(dst, src net.Conn) (int64, error) {
+	dstTCP, dstOK := dst.(*net.TCPConn)
+	srcTCP, srcOK := src.(*net.TCPConn)
+	if dstOK && srcOK {
+		spliced, err := spliceCopy(dstTCP, srcTCP)
+		if err == nil {
+			return spliced, nil
+		}
+		// The stream position on both ends reflects exactly what spliceCopy
+		// already moved, so copyBuffer can safely continue from here.
+		rest, err := copyBuffer(dst, src)
+		return spliced + rest, err
+	}
+	return copyBuffer(dst, src)
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceCopy relays src to dst using splice(2) through an intermediate
+// pipe, so data is moved entirely in kernel space without ever being copied
+// into a userspace buffer. It requires both ends to be *net.TCPConn; the
+// caller falls back to copyBuffer otherwise.
+//
+// The splice calls run against src/dst's own fd via SyscallConn, not a
+// dup'd one from *net.TCPConn.File: File's fd is independent of the
+// original, so closing src or dst (as tcpHandleConnection's shutdown watcher
+// does on context cancellation) would never interrupt a splice blocked on
+// the dup. Driving the syscalls through SyscallConn's Read/Write keeps them
+// on the runtime-integrated fd, so a concurrent Close unblocks them exactly
+// as it would an ordinary Read/Write.
+func spliceCopy(dst, src *net.TCPConn) (int64, error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	pipeFds := make([]int, 2)
+	if err := unix.Pipe2(pipeFds, unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, err
+	}
+	defer unix.Close(pipeFds[0])
+	defer unix.Close(pipeFds[1])
+
+	var total int64
+	for {
+		n, err := spliceReadSide(srcRaw, func(fd int) (int64, error) {
+			return unix.Splice(fd, nil, pipeFds[1], nil, spliceChunkSize, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		})
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+
+		var written int64
+		for written < n {
+			w, err := spliceWriteSide(dstRaw, func(fd int) (int64, error) {
+				return unix.Splice(pipeFds[0], nil, fd, nil, int(n-written), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			})
+			if err != nil {
+				return total + written, err
+			}
+			written += w
+		}
+		total += written
+	}
+}
+
+// spliceReadSide runs call, which splices out of raw's fd, under
+// SyscallConn.Read so the runtime poller waits for raw to become readable
+// and retries on EAGAIN instead of busy-looping. Driving the syscall through
+// raw (rather than a dup'd fd from File) is what lets a concurrent Close on
+// the net.Conn owning raw interrupt a pending splice.
+func spliceReadSide(raw syscall.RawConn, call func(fd int) (int64, error)) (int64, error) {
+	var n int64
+	var callErr error
+	err := raw.Read(func(fd uintptr) bool {
+		n, callErr = call(int(fd))
+		return callErr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, callErr
+}
+
+// spliceWriteSide is spliceReadSide's counterpart for call splicing into
+// raw's fd: it waits on writability via SyscallConn.Write instead of
+// readability, since that is the condition EAGAIN here is signaling.
+func spliceWriteSide(raw syscall.RawConn, call func(fd int) (int64, error)) (int64, error) {
+	var n int64
+	var callErr error
+	err := raw.Write(func(fd uintptr) bool {
+		n, callErr = call(int(fd))
+		return callErr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, callErr
+}
+
+// spliceChunkSize bounds how much data a single pair of Splice calls moves
+// through the intermediate pipe.
+const spliceChunkSize = 1 << 20
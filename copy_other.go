@@ -0,0 +1,22 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// spliceCopy is unavailable outside Linux; copyBuffer is used instead.
+func spliceCopy(dst, src *net.TCPConn) (int64, error) {
+	return 0, errSpliceUnsupported
+}
+
+var errSpliceUnsupported = errNotSupported("splice is only available on linux")
+
+type errNotSupported string
+
+func (e errNotSupported) Error() string { return string(e) }
@@ -0,0 +1,153 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// dialAttempt is the result of racing a single upstream address.
+type dialAttempt struct {
+	conn   net.Conn
+	family int
+	err    error
+}
+
+// DialUpstream connects to targetPort on the upstream target for saddr,
+// using whichever of Opts.TargetAddr4 and Opts.TargetAddr6 is configured.
+// When both families
+// are configured it races them Happy-Eyeballs style (RFC 8305): the
+// preferred family (matching saddr's own version) is dialed first, and the
+// other family is dialed after Opts.HappyEyeballsDelay if the first hasn't
+// completed, so a half-broken backend in one family does not black-hole
+// clients. The first successful connection wins; the loser, if any, is
+// closed. LocalAddr and DialUpstreamControl are set per dial the same way a
+// single-family dial would set them.
+func DialUpstream(ctx context.Context, saddr net.Addr, targetPort int) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, Opts.UpstreamDialTimeout)
+	defer cancel()
+
+	preferred := AddrVersion(saddr)
+	families := upstreamFamilies(preferred)
+	if len(families) == 0 {
+		return nil, fmt.Errorf("no upstream target configured")
+	}
+	if len(families) == 1 {
+		return dialFamily(ctx, saddr, families[0], targetPort)
+	}
+
+	results := make(chan dialAttempt, len(families))
+	// pending tracks dials that have been started but whose result hasn't
+	// been consumed yet -- the loop bound below must track this, not the
+	// total number of dials ever started, since each consumed result only
+	// ever produces one more (from the fallback dial it may trigger).
+	var pending int
+
+	dial := func(family int) {
+		pending++
+		go func() {
+			conn, err := dialFamily(ctx, saddr, family, targetPort)
+			results <- dialAttempt{conn: conn, family: family, err: err}
+		}()
+	}
+
+	dial(families[0])
+
+	timer := time.NewTimer(Opts.HappyEyeballsDelay)
+	defer timer.Stop()
+
+	var firstErr error
+
+	select {
+	case <-timer.C:
+		dial(families[1])
+	case res := <-results:
+		pending--
+		if res.err == nil {
+			go drainAndCloseLosers(results, pending)
+			return res.conn, nil
+		}
+		firstErr = res.err
+		dial(families[1])
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go drainAndCloseLosers(results, pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, firstErr
+}
+
+// drainAndCloseLosers reads the remaining n in-flight dial results after a
+// winner has already been chosen, closing any connection that still
+// succeeds so it is not leaked.
+func drainAndCloseLosers(results <-chan dialAttempt, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.err == nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// upstreamFamilies returns the configured target IP versions (4, 6, or
+// both), with preferred sorted first when both are present.
+func upstreamFamilies(preferred int) []int {
+	have4 := Opts.TargetAddr4 != ""
+	have6 := Opts.TargetAddr6 != ""
+
+	switch {
+	case have4 && have6:
+		if preferred == 6 {
+			return []int{6, 4}
+		}
+		return []int{4, 6}
+	case have4:
+		return []int{4}
+	case have6:
+		return []int{6}
+	default:
+		return nil
+	}
+}
+
+// dialFamily is a var, rather than a plain func, so tests can substitute a
+// fake dialer and exercise DialUpstream's race/cleanup logic deterministically,
+// without depending on real network timing.
+var dialFamily = func(ctx context.Context, saddr net.Addr, family int, targetPort int) (net.Conn, error) {
+	targetIP := Opts.TargetAddr6
+	if family == 4 {
+		targetIP = Opts.TargetAddr4
+	}
+	targetAddr := targetIP + ":" + fmt.Sprint(targetPort)
+
+	dialer := net.Dialer{LocalAddr: saddr}
+	if saddr != nil {
+		dialer.Control = DialUpstreamControl(saddr.(*net.TCPAddr).Port)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", targetAddr)
+	if err != nil {
+		incUpstreamDialError()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn that only tracks whether Close was called,
+// for exercising DialUpstream's race and cleanup logic without real network
+// I/O.
+type fakeConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (c *fakeConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestDialUpstreamHappyEyeballsRace(t *testing.T) {
+	origDialFamily, origOpts := dialFamily, Opts
+	defer func() { dialFamily, Opts = origDialFamily, origOpts }()
+
+	Opts.TargetAddr4 = "203.0.113.1"
+	Opts.TargetAddr6 = "2001:db8::1"
+	Opts.HappyEyeballsDelay = 10 * time.Millisecond
+	Opts.UpstreamDialTimeout = time.Second
+
+	winner, loser := newFakeConn(), newFakeConn()
+
+	dialFamily = func(ctx context.Context, saddr net.Addr, family int, targetPort int) (net.Conn, error) {
+		// Deliberately ignore ctx here: a real dial can also complete
+		// successfully just after DialUpstream's context is canceled by its
+		// winning sibling (that race is exactly why drainAndCloseLosers
+		// exists), so the fake must keep "succeeding" regardless of ctx to
+		// exercise that cleanup path instead of just erroring out early.
+		switch family {
+		case 4:
+			// The preferred family is dialed first but resolves slowest, so
+			// it must lose the race even though it started earlier.
+			time.Sleep(100 * time.Millisecond)
+			return loser, nil
+		case 6:
+			time.Sleep(20 * time.Millisecond)
+			return winner, nil
+		default:
+			t.Fatalf("unexpected family %d", family)
+			return nil, nil
+		}
+	}
+
+	saddr := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}
+	conn, err := DialUpstream(context.Background(), saddr, 443)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn != net.Conn(winner) {
+		t.Fatalf("got %v, want the faster family's connection", conn)
+	}
+
+	select {
+	case <-loser.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("loser connection was never closed by drainAndCloseLosers")
+	}
+}
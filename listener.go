@@ -0,0 +1,96 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListenerSpec configures one listening socket and the ConnMiddleware chain
+// applied to every connection it accepts, parsed from a repeated -listener
+// flag of the form "tcp://:2222?mode=proxy2" or
+// "tcp://:8443?mode=tls+proxy2&cert=/path/fullchain.pem&key=/path/privkey.pem".
+type ListenerSpec struct {
+	Network string // currently always "tcp"
+	Port    int
+	Mode    string // e.g. "proxy2", "tls+proxy2", "forwarded"
+	Cert    string // TLS certificate path, required when Mode includes "tls"
+	Key     string // TLS key path, required when Mode includes "tls"
+}
+
+// ParseListenerSpec parses one -listener flag value.
+func ParseListenerSpec(raw string) (ListenerSpec, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: %w", raw, err)
+	}
+	if u.Scheme != "tcp" {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: unsupported scheme %q", raw, u.Scheme)
+	}
+
+	portStr := u.Port()
+	if portStr == "" {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: missing port", raw)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: bad port %q", raw, portStr)
+	}
+
+	query := u.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "proxy2"
+	}
+
+	spec := ListenerSpec{
+		Network: u.Scheme,
+		Port:    port,
+		Mode:    mode,
+		Cert:    query.Get("cert"),
+		Key:     query.Get("key"),
+	}
+
+	if strings.Contains(mode, "tls") && (spec.Cert == "" || spec.Key == "") {
+		return ListenerSpec{}, fmt.Errorf("invalid listener %q: mode %q requires cert and key", raw, mode)
+	}
+
+	return spec, nil
+}
+
+// BuildMiddlewareChain resolves spec.Mode ("+"-separated stages, outermost
+// first) into the ConnMiddleware chain TCPListen should run every accepted
+// connection through.
+func BuildMiddlewareChain(spec ListenerSpec) ([]ConnMiddleware, error) {
+	var chain []ConnMiddleware
+
+	// url.Values decodes a literal "+" in a query value as a space (the
+	// application/x-www-form-urlencoded convention), so "mode=tls+proxy2"
+	// on the command line arrives here as "tls proxy2"; accept either.
+	stages := strings.FieldsFunc(spec.Mode, func(r rune) bool { return r == '+' || r == ' ' })
+
+	for _, stage := range stages {
+		switch stage {
+		case "proxy1", "proxy2":
+			chain = append(chain, ProxyProtocolMiddleware{})
+		case "tls":
+			cert, err := tls.LoadX509KeyPair(spec.Cert, spec.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS cert/key for listener on port %d: %w", spec.Port, err)
+			}
+			chain = append(chain, TLSMiddleware{Config: &tls.Config{Certificates: []tls.Certificate{cert}}})
+		case "forwarded":
+			chain = append(chain, ForwardedMiddleware{})
+		default:
+			return nil, fmt.Errorf("unknown listener mode stage %q in %q", stage, spec.Mode)
+		}
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParseListenerSpecDefaultMode(t *testing.T) {
+	spec, err := ParseListenerSpec("tcp://:2222")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spec.Port != 2222 || spec.Mode != "proxy2" {
+		t.Fatalf("got %+v, want port 2222 mode proxy2", spec)
+	}
+}
+
+func TestParseListenerSpecTLSRequiresCertAndKey(t *testing.T) {
+	if _, err := ParseListenerSpec("tcp://:8443?mode=tls+proxy2"); err == nil {
+		t.Fatal("expected an error for a tls mode missing cert/key, got nil")
+	}
+
+	spec, err := ParseListenerSpec("tcp://:8443?mode=tls+proxy2&cert=/tmp/c.pem&key=/tmp/k.pem")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spec.Cert != "/tmp/c.pem" || spec.Key != "/tmp/k.pem" {
+		t.Fatalf("got %+v", spec)
+	}
+}
+
+func TestBuildMiddlewareChainHandlesPlusOrSpace(t *testing.T) {
+	// url.Values decodes a literal "+" in a query value as a space, so
+	// BuildMiddlewareChain must treat both the same way; "forwarded+proxy2"
+	// avoids the "tls" stage here so the test doesn't need a real cert/key.
+	for _, mode := range []string{"forwarded+proxy2", "forwarded proxy2"} {
+		chain, err := BuildMiddlewareChain(ListenerSpec{Port: 2222, Mode: mode})
+		if err != nil {
+			t.Fatalf("mode %q: unexpected error: %v", mode, err)
+		}
+		if len(chain) != 2 {
+			t.Fatalf("mode %q: got %d middlewares, want 2", mode, len(chain))
+		}
+	}
+}
+
+func TestBuildMiddlewareChainUnknownStage(t *testing.T) {
+	_, err := BuildMiddlewareChain(ListenerSpec{Port: 2222, Mode: "bogus"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown mode stage, got nil")
+	}
+}
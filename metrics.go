@@ -0,0 +1,137 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// metricsShutdownGrace bounds how long ListenMetrics waits for in-flight
+// scrapes to finish when ctx is canceled.
+const metricsShutdownGrace = 5 * time.Second
+
+// Metrics holds every Prometheus collector mmproxy reports on the optional
+// -metrics-addr HTTP endpoint.
+type Metrics struct {
+	ConnectionsTotal       *prometheus.CounterVec
+	BytesTransferredTotal  *prometheus.CounterVec
+	ProxyHeaderParseErrors *prometheus.CounterVec
+	UpstreamDialErrors     prometheus.Counter
+	ActiveConnections      prometheus.GaugeFunc
+	ConnectionDuration     *prometheus.HistogramVec
+}
+
+// NewMetrics registers and returns the collectors used throughout the proxy.
+// activeConns is polled on scrape to populate the active-connections gauge.
+func NewMetrics(activeConns func() int) *Metrics {
+	return &Metrics{
+		ConnectionsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "mmproxy_connections_total",
+			Help: "Total number of connections handled, partitioned by protocol, IP version and result.",
+		}, []string{"proto", "version", "result"}),
+
+		BytesTransferredTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "mmproxy_bytes_transferred_total",
+			Help: "Total bytes relayed between clients and upstreams, partitioned by direction.",
+		}, []string{"direction"}),
+
+		ProxyHeaderParseErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "mmproxy_proxy_header_parse_errors_total",
+			Help: "Total number of PROXY protocol header parse failures, partitioned by reason.",
+		}, []string{"reason"}),
+
+		UpstreamDialErrors: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "mmproxy_upstream_dial_errors_total",
+			Help: "Total number of failures dialing the upstream target.",
+		}),
+
+		ActiveConnections: promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mmproxy_active_connections",
+			Help: "Number of connections currently being relayed.",
+		}, func() float64 { return float64(activeConns()) }),
+
+		ConnectionDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mmproxy_connection_duration_seconds",
+			Help:    "Duration of relayed connections in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"proto"}),
+	}
+}
+
+// metrics is the process-wide collector set, populated by SetupMetrics when
+// -metrics-addr is configured. It stays nil otherwise, and every helper
+// below is a no-op in that case, mirroring how logging is skipped based on
+// Opts.Verbose.
+var metrics *Metrics
+
+// SetupMetrics registers the collectors and makes them available to the
+// connection-handling helpers in this package.
+func SetupMetrics(activeConns func() int) *Metrics {
+	metrics = NewMetrics(activeConns)
+	return metrics
+}
+
+func incConnectionsTotal(proto, version, result string) {
+	if metrics != nil {
+		metrics.ConnectionsTotal.WithLabelValues(proto, version, result).Inc()
+	}
+}
+
+func addBytesTransferred(direction string, n int) {
+	if metrics != nil && n > 0 {
+		metrics.BytesTransferredTotal.WithLabelValues(direction).Add(float64(n))
+	}
+}
+
+func incProxyHeaderParseError(reason string) {
+	if metrics != nil {
+		metrics.ProxyHeaderParseErrors.WithLabelValues(reason).Inc()
+	}
+}
+
+func incUpstreamDialError() {
+	if metrics != nil {
+		metrics.UpstreamDialErrors.Inc()
+	}
+}
+
+func observeConnectionDuration(proto string, d time.Duration) {
+	if metrics != nil {
+		metrics.ConnectionDuration.WithLabelValues(proto).Observe(d.Seconds())
+	}
+}
+
+// ListenMetrics starts an HTTP server exposing the default Prometheus
+// registry on addr at /metrics. It runs until ctx is canceled.
+func ListenMetrics(ctx context.Context, addr string, logger *zap.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logger.Info("metrics listening", zap.String("addr", addr))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownGrace)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortMapping associates a contiguous range of listen ports with a
+// contiguous range of upstream target ports. ListenStart/ListenEnd and
+// TargetStart/TargetEnd are both inclusive. A mapping is either 1:1/N:N
+// (TargetEnd-TargetStart == ListenEnd-ListenStart, ports shift in lockstep)
+// or N:1 (TargetStart == TargetEnd, every listen port in the range maps to
+// the same single target port).
+//
+// PortMapping, -listen-ports parsing and Server's shutdown/metrics plumbing
+// are written protocol-agnostically so a UDPListen built on top of them
+// would not need its own port-range or lifecycle handling. This tree is
+// TCP-only, though: there is no udpHandleConnection, no UDP entry in
+// metrics.go's labels, and no wiring for a -listen-ports UDP mode, so a
+// matching UDP listener remains unimplemented here rather than bolted on
+// without the read-buffer/connection-tracking design that a stateful UDP
+// relay needs to get right.
+type PortMapping struct {
+	ListenStart int
+	ListenEnd   int
+	TargetStart int
+	TargetEnd   int
+}
+
+// TargetPort returns the upstream port that listenPort maps to under m.
+// listenPort must satisfy m.ListenStart <= listenPort <= m.ListenEnd.
+func (m PortMapping) TargetPort(listenPort int) int {
+	if m.TargetStart == m.TargetEnd {
+		return m.TargetStart
+	}
+	return m.TargetStart + (listenPort - m.ListenStart)
+}
+
+// ParsePortMappings parses the -listen-ports DSL: a comma-separated list of
+// entries, each either a bare range/port ("8000-8100", "9000") meaning the
+// target port equals the listen port, or an explicit "listen:target"
+// mapping ("9500-9600:19500-19600") where both sides are a single port or a
+// range. A range on the target side must either have the same span as the
+// listen range (N:N) or be a single port (N:1); any other combination is a
+// span mismatch. Overlapping listen ranges across entries are rejected.
+func ParsePortMappings(spec string) ([]PortMapping, error) {
+	var mappings []PortMapping
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		listenPart, targetPart, hasTarget := strings.Cut(entry, ":")
+
+		listenStart, listenEnd, err := parsePortRange(listenPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen range %q: %w", listenPart, err)
+		}
+
+		targetStart, targetEnd := listenStart, listenEnd
+		if hasTarget {
+			targetStart, targetEnd, err = parsePortRange(targetPart)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target range %q: %w", targetPart, err)
+			}
+
+			listenSpan := listenEnd - listenStart
+			targetSpan := targetEnd - targetStart
+			if targetSpan != 0 && targetSpan != listenSpan {
+				return nil, fmt.Errorf(
+					"port span mismatch in %q: listen range covers %d port(s), target range covers %d port(s)",
+					entry, listenSpan+1, targetSpan+1)
+			}
+		}
+
+		mappings = append(mappings, PortMapping{
+			ListenStart: listenStart,
+			ListenEnd:   listenEnd,
+			TargetStart: targetStart,
+			TargetEnd:   targetEnd,
+		})
+	}
+
+	if err := checkOverlaps(mappings); err != nil {
+		return nil, err
+	}
+
+	return mappings, nil
+}
+
+func parsePortRange(s string) (start int, end int, err error) {
+	before, after, isRange := strings.Cut(s, "-")
+
+	start, err = parsePort(before)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !isRange {
+		return start, start, nil
+	}
+
+	end, err = parsePort(after)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if end < start {
+		return 0, 0, fmt.Errorf("range end %d is before range start %d", end, start)
+	}
+
+	return start, end, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid port number", s)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range 1-65535", port)
+	}
+	return port, nil
+}
+
+func checkOverlaps(mappings []PortMapping) error {
+	sorted := make([]PortMapping, len(mappings))
+	copy(sorted, mappings)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ListenStart < sorted[j].ListenStart })
+
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].ListenStart <= sorted[i-1].ListenEnd {
+			return fmt.Errorf("overlapping listen ports: %d-%d overlaps %d-%d",
+				sorted[i-1].ListenStart, sorted[i-1].ListenEnd, sorted[i].ListenStart, sorted[i].ListenEnd)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortMappingsBasic(t *testing.T) {
+	got, err := ParsePortMappings("8000-8100,9000,9500-9600:19500-19600")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []PortMapping{
+		{ListenStart: 8000, ListenEnd: 8100, TargetStart: 8000, TargetEnd: 8100},
+		{ListenStart: 9000, ListenEnd: 9000, TargetStart: 9000, TargetEnd: 9000},
+		{ListenStart: 9500, ListenEnd: 9600, TargetStart: 19500, TargetEnd: 19600},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParsePortMappingsNToOne(t *testing.T) {
+	got, err := ParsePortMappings("8000-8010:9000")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []PortMapping{{ListenStart: 8000, ListenEnd: 8010, TargetStart: 9000, TargetEnd: 9000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	m := got[0]
+	if p := m.TargetPort(8000); p != 9000 {
+		t.Errorf("TargetPort(8000) = %d, want 9000", p)
+	}
+	if p := m.TargetPort(8010); p != 9000 {
+		t.Errorf("TargetPort(8010) = %d, want 9000", p)
+	}
+}
+
+func TestParsePortMappingsNToN(t *testing.T) {
+	got, err := ParsePortMappings("9500-9600:19500-19600")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := got[0]
+	if p := m.TargetPort(9500); p != 19500 {
+		t.Errorf("TargetPort(9500) = %d, want 19500", p)
+	}
+	if p := m.TargetPort(9550); p != 19550 {
+		t.Errorf("TargetPort(9550) = %d, want 19550", p)
+	}
+}
+
+func TestParsePortMappingsSpanMismatch(t *testing.T) {
+	_, err := ParsePortMappings("8000-8100:9000-9050")
+	if err == nil {
+		t.Fatal("expected a span mismatch error, got nil")
+	}
+}
+
+func TestParsePortMappingsOverlap(t *testing.T) {
+	_, err := ParsePortMappings("8000-8100,8050-8200")
+	if err == nil {
+		t.Fatal("expected an overlap error, got nil")
+	}
+}
+
+func TestParsePortMappingsInvalidPort(t *testing.T) {
+	cases := []string{"0", "70000", "abc", "8100-8000"}
+	for _, c := range cases {
+		if _, err := ParsePortMappings(c); err == nil {
+			t.Errorf("ParsePortMappings(%q): expected error, got nil", c)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// TLV is a single PROXY protocol v2 Type-Length-Value block, as described in
+// section 2.2 of the PROXY protocol spec.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Well-known PROXY protocol v2 TLV types that mmproxy knows how to inject
+// when rewriting a header for the upstream connection.
+const (
+	PP2TypeAuthority = 0x02 // TLS SNI, forwarded as PP2_TYPE_AUTHORITY
+	PP2TypeSSL       = 0x20
+	PP2TypeUniqueID  = 0x05
+)
+
+var proxyV2Signature = [12]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Values accepted by the -upstream-proxy-protocol flag, controlling what
+// tcpHandleConnection sends to the upstream connection ahead of the
+// relayed payload.
+const (
+	// UpstreamProxyProtocolNone sends nothing beyond the client's own
+	// payload, the historical go-mmproxy behavior that relies on
+	// SO_IP_TRANSPARENT to preserve the original source address.
+	UpstreamProxyProtocolNone = "none"
+	// UpstreamProxyProtocolPassthrough forwards the original PROXY v2
+	// header verbatim, for upstreams that are themselves PROXY-aware.
+	UpstreamProxyProtocolPassthrough = "passthrough"
+	// UpstreamProxyProtocolRewrite builds a fresh PROXY v2 header from the
+	// parsed source address and TLVs, with the upstream connection's own
+	// address as the destination.
+	UpstreamProxyProtocolRewrite = "rewrite"
+)
+
+// DecodeTLVs parses a sequence of back-to-back TLV blocks, as found
+// following the fixed address section of a PROXY v2 header.
+func DecodeTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("truncated TLV header: %d byte(s) left", len(b))
+		}
+		typ := b[0]
+		length := int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[3:]
+		if len(b) < length {
+			return nil, fmt.Errorf("truncated TLV value: want %d byte(s), have %d", length, len(b))
+		}
+		value := make([]byte, length)
+		copy(value, b[:length])
+		tlvs = append(tlvs, TLV{Type: typ, Value: value})
+		b = b[length:]
+	}
+	return tlvs, nil
+}
+
+// EncodeTLVs serializes tlvs back into the on-wire back-to-back TLV format.
+func EncodeTLVs(tlvs []TLV) []byte {
+	var out []byte
+	for _, t := range tlvs {
+		header := make([]byte, 3)
+		header[0] = t.Type
+		binary.BigEndian.PutUint16(header[1:3], uint16(len(t.Value)))
+		out = append(out, header...)
+		out = append(out, t.Value...)
+	}
+	return out
+}
+
+// BuildProxyV2Header constructs a fresh PROXY protocol v2 PROXY/TCP header
+// carrying saddr as the source and daddr as the destination, followed by
+// tlvs. Both addrs must be *net.TCPAddr of the same IP version.
+func BuildProxyV2Header(saddr, daddr *net.TCPAddr, tlvs []TLV) ([]byte, error) {
+	sip4, dip4 := saddr.IP.To4(), daddr.IP.To4()
+	var famProto byte
+	var addrBytes []byte
+
+	switch {
+	case sip4 != nil && dip4 != nil:
+		famProto = 0x11 // AF_INET << 4 | STREAM
+		addrBytes = make([]byte, 12)
+		copy(addrBytes[0:4], sip4)
+		copy(addrBytes[4:8], dip4)
+		binary.BigEndian.PutUint16(addrBytes[8:10], uint16(saddr.Port))
+		binary.BigEndian.PutUint16(addrBytes[10:12], uint16(daddr.Port))
+	case sip4 == nil && dip4 == nil:
+		famProto = 0x21 // AF_INET6 << 4 | STREAM
+		addrBytes = make([]byte, 36)
+		copy(addrBytes[0:16], saddr.IP.To16())
+		copy(addrBytes[16:32], daddr.IP.To16())
+		binary.BigEndian.PutUint16(addrBytes[32:34], uint16(saddr.Port))
+		binary.BigEndian.PutUint16(addrBytes[34:36], uint16(daddr.Port))
+	default:
+		return nil, fmt.Errorf("saddr and daddr must be the same IP version")
+	}
+
+	tlvBytes := EncodeTLVs(tlvs)
+
+	header := make([]byte, 0, 16+len(addrBytes)+len(tlvBytes))
+	header = append(header, proxyV2Signature[:]...)
+	header = append(header, 0x21) // version 2, command PROXY
+	header = append(header, famProto)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrBytes)+len(tlvBytes)))
+	header = append(header, length...)
+	header = append(header, addrBytes...)
+	header = append(header, tlvBytes...)
+
+	return header, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTLVRoundTrip(t *testing.T) {
+	want := []TLV{
+		{Type: PP2TypeAuthority, Value: []byte("example.com")},
+		{Type: PP2TypeUniqueID, Value: []byte{0x01, 0x02, 0x03, 0x04}},
+	}
+
+	encoded := EncodeTLVs(want)
+	got, err := DecodeTLVs(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeTLVsEmpty(t *testing.T) {
+	got, err := DecodeTLVs(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("got %+v, want empty", got)
+	}
+}
+
+func TestDecodeTLVsTruncated(t *testing.T) {
+	if _, err := DecodeTLVs([]byte{0x02, 0x00}); err == nil {
+		t.Fatal("expected an error for a truncated TLV header, got nil")
+	}
+
+	encoded := EncodeTLVs([]TLV{{Type: PP2TypeSSL, Value: []byte{0x01, 0x02, 0x03}}})
+	if _, err := DecodeTLVs(encoded[:len(encoded)-1]); err == nil {
+		t.Fatal("expected an error for a truncated TLV value, got nil")
+	}
+}
+
+func TestBuildProxyV2HeaderIPv4RoundTrip(t *testing.T) {
+	saddr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51413}
+	daddr := &net.TCPAddr{IP: net.ParseIP("198.51.100.20"), Port: 443}
+	tlvs := []TLV{{Type: PP2TypeAuthority, Value: []byte("example.com")}}
+
+	header, err := BuildProxyV2Header(saddr, daddr, tlvs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(header[:12]) != string(proxyV2Signature[:]) {
+		t.Fatalf("unexpected signature: %x", header[:12])
+	}
+	if header[12] != 0x21 {
+		t.Fatalf("unexpected version/command byte: %x", header[12])
+	}
+	if header[13] != 0x11 {
+		t.Fatalf("unexpected family/protocol byte for IPv4: %x", header[13])
+	}
+
+	gotTLVs, err := DecodeTLVs(header[16+12:])
+	if err != nil {
+		t.Fatalf("failed to decode trailing TLVs: %v", err)
+	}
+	if !reflect.DeepEqual(gotTLVs, tlvs) {
+		t.Fatalf("got %+v, want %+v", gotTLVs, tlvs)
+	}
+}
+
+func TestBuildProxyV2HeaderMixedVersionsRejected(t *testing.T) {
+	saddr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51413}
+	daddr := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	if _, err := BuildProxyV2Header(saddr, daddr, nil); err == nil {
+		t.Fatal("expected an error when mixing IPv4 and IPv6 addresses, got nil")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Server owns the TCP listeners spawned by TCPListen and the lifecycle of
+// the connections they accept. It exists so that a single Shutdown call can
+// stop accepting new connections, close every listener and wait for
+// in-flight tcpHandleConnection goroutines to drain
+// instead of the process being killed out from under them.
+type Server struct {
+	logger *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	listeners []net.Listener
+
+	active sync.WaitGroup
+
+	// inFlight counts running connection handlers, with or without a cap.
+	inFlight atomic.Int64
+
+	// conns bounds the number of simultaneously active connections so a
+	// burst of traffic cannot exhaust file descriptors. A zero value means
+	// unbounded, matching the previous behavior.
+	conns chan struct{}
+}
+
+// NewServer creates a Server whose root context is derived from ctx and
+// whose concurrent connection count is capped at maxConns (0 for no cap).
+func NewServer(ctx context.Context, logger *zap.Logger, maxConns int) *Server {
+	serverCtx, cancel := context.WithCancel(ctx)
+
+	s := &Server{
+		logger: logger,
+		ctx:    serverCtx,
+		cancel: cancel,
+	}
+	if maxConns > 0 {
+		s.conns = make(chan struct{}, maxConns)
+	}
+	return s
+}
+
+// Context returns the Server's root context. It is canceled when Shutdown
+// is called.
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// ActiveConnections returns the number of connections currently being
+// relayed, for exposure on the metrics endpoint.
+func (s *Server) ActiveConnections() int {
+	return int(s.inFlight.Load())
+}
+
+// trackListener registers ln so Shutdown can close it.
+func (s *Server) trackListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, ln)
+}
+
+// acquire blocks until a connection slot is available or ctx is done,
+// reporting whether a slot was acquired. It must be paired with a release
+// call when acquire returns true.
+func (s *Server) acquire(ctx context.Context) bool {
+	if s.conns == nil {
+		return true
+	}
+	select {
+	case s.conns <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Server) release() {
+	if s.conns != nil {
+		<-s.conns
+	}
+}
+
+// handle runs fn for an accepted connection under the Server's WaitGroup and
+// connection semaphore, so Shutdown can observe and wait for it. conn is the
+// connection fn is responsible for; if a slot cannot be acquired before the
+// Server's context is done (i.e. Shutdown raced the accept), handle closes
+// conn itself rather than leaving it to the caller, since fn never runs to
+// do so.
+func (s *Server) handle(conn io.Closer, fn func(ctx context.Context)) {
+	if !s.acquire(s.ctx) {
+		conn.Close()
+		return
+	}
+	s.active.Add(1)
+	s.inFlight.Add(1)
+	go func() {
+		defer s.active.Done()
+		defer s.release()
+		defer s.inFlight.Add(-1)
+		fn(s.ctx)
+	}()
+}
+
+// Shutdown stops all listeners from accepting new connections and waits for
+// active connection handlers to finish, up to ctx's deadline. It is safe to
+// call once per Server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+
+	s.mu.Lock()
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitShutdown blocks until sigCh delivers a signal, then calls Shutdown
+// with the given grace period. It is intended to be run from main after
+// wiring sigCh with signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM).
+func (s *Server) WaitShutdown(sigCh <-chan os.Signal, grace time.Duration) error {
+	sig := <-sigCh
+	s.logger.Info("shutting down", zap.Stringer("signal", sig), zap.Duration("grace", grace))
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
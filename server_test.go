@@ -0,0 +1,82 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeCloser is a minimal io.Closer that records whether Close was called.
+type fakeCloser struct {
+	closed chan struct{}
+}
+
+func newFakeCloser() *fakeCloser {
+	return &fakeCloser{closed: make(chan struct{})}
+}
+
+func (c *fakeCloser) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// TestServerShutdownClosesConnBlockedOnAcquire guards against regressing the
+// race fixed alongside the accept-loop rework: a handle() call still
+// blocked waiting for a connection slot when Shutdown cancels the Server's
+// context must close the conn it was given, since its fn will never run to
+// do so otherwise.
+func TestServerShutdownClosesConnBlockedOnAcquire(t *testing.T) {
+	server := NewServer(context.Background(), zap.NewNop(), 1)
+
+	// Occupy the single connection slot with a handler that blocks until the
+	// test releases it, so the next handle() call has to wait on acquire.
+	release := make(chan struct{})
+	occupied := make(chan struct{})
+	server.handle(newFakeCloser(), func(ctx context.Context) {
+		close(occupied)
+		<-release
+	})
+	<-occupied
+
+	blockedConn := newFakeCloser()
+	blockedReturned := make(chan struct{})
+	go func() {
+		server.handle(blockedConn, func(ctx context.Context) {
+			t.Error("fn should never run: the slot was never acquired")
+		})
+		close(blockedReturned)
+	}()
+
+	// Give the second handle() a moment to actually start blocking on
+	// acquire before Shutdown races it.
+	time.Sleep(20 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-blockedConn.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked handle's conn was never closed by Shutdown")
+	}
+	<-blockedReturned
+
+	close(release)
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown never returned")
+	}
+}
@@ -7,23 +7,65 @@ package main
 import (
 	"context"
 	"go.uber.org/zap"
-	"io"
 	"net"
 	"strconv"
+	"time"
 )
 
-func tcpCopyData(dst net.Conn, src net.Conn, ch chan<- error) {
-	_, err := io.Copy(dst, src)
+// writeAll writes the whole of b to conn, handling short writes.
+func writeAll(conn net.Conn, b []byte) error {
+	for len(b) > 0 {
+		n, err := conn.Write(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// tcpCopyData relays src to dst, preferring the splice fast path (see
+// relayConn) and recording the number of bytes transferred in the given
+// direction ("upstream" or "downstream").
+func tcpCopyData(dst net.Conn, src net.Conn, direction string, ch chan<- error) {
+	n, err := relayConn(dst, src)
+	addBytesTransferred(direction, int(n))
 	ch <- err
 }
 
-func tcpHandleConnection(conn net.Conn, logger *zap.Logger) {
+// defaultMiddlewares is the chain used by listeners bound from
+// Opts.PortMappings (the -listen-ports DSL), preserving the historical
+// raw-PROXY-header behavior for listeners that don't opt into the
+// -listener flag's richer mode selection.
+var defaultMiddlewares = []ConnMiddleware{ProxyProtocolMiddleware{}}
+
+func tcpHandleConnection(ctx context.Context, conn net.Conn, logger *zap.Logger, mapping PortMapping, listenPort int, middlewares []ConnMiddleware) {
+	start := time.Now()
+	result := "error"
+	defer func() {
+		observeConnectionDuration("tcp", time.Since(start))
+		incConnectionsTotal("tcp", strconv.Itoa(AddrVersion(conn.RemoteAddr())), result)
+	}()
+
 	defer conn.Close()
 	logger = logger.With(zap.String("remoteAddr", conn.RemoteAddr().String()),
 		zap.String("localAddr", conn.LocalAddr().String()))
 
+	// Closing conn unblocks any in-flight Read/Write when the server is
+	// asked to shut down, so Shutdown's WaitGroup does not hang forever.
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopWatch:
+		}
+	}()
+
 	if !CheckOriginAllowed(conn.RemoteAddr().(*net.TCPAddr).IP) {
 		logger.Debug("connection origin not in allowed subnets", zap.Bool("dropConnection", true))
+		result = "origin_not_allowed"
 		return
 	}
 
@@ -31,131 +73,190 @@ func tcpHandleConnection(conn net.Conn, logger *zap.Logger) {
 		logger.Debug("new connection")
 	}
 
-	buffer := GetBuffer()
-	defer func() {
-		if buffer != nil {
-			PutBuffer(buffer)
-		}
-	}()
-
-	n, err := conn.Read(buffer)
+	wrapped, meta, err := ApplyMiddlewares(conn, middlewares)
 	if err != nil {
-		logger.Debug("failed to read PROXY header", zap.Error(err), zap.Bool("dropConnection", true))
+		logger.Debug("failed to apply listener middlewares", zap.Error(err), zap.Bool("dropConnection", true))
+		incProxyHeaderParseError("middleware")
 		return
 	}
+	saddr, tlvs := meta.SourceAddr, meta.TLVs
 
-	saddr, _, restBytes, err := PROXYReadRemoteAddr(buffer[:n], TCP)
-	if err != nil {
-		logger.Debug("failed to parse PROXY header", zap.Error(err), zap.Bool("dropConnection", true))
-		return
-	}
-
-	port := []rune("190.115.196.10:10000")[Opts.ListenAddrLen:Opts.ListenAddrLen+5]
-	targetAddr := Opts.TargetAddr6 + ":" + string(port)
-	if AddrVersion(saddr) == 4 {
-		targetAddr = Opts.TargetAddr4 + ":" + string(port)
-	}
+	targetPort := mapping.TargetPort(listenPort)
 
 	clientAddr := "UNKNOWN"
 	if saddr != nil {
 		clientAddr = saddr.String()
 	}
-	logger = logger.With(zap.String("clientAddr", clientAddr), zap.String("targetAddr", targetAddr))
+	logger = logger.With(zap.String("clientAddr", clientAddr), zap.Int("targetPort", targetPort))
 	if Opts.Verbose > 1 {
-		logger.Debug("successfully parsed PROXY header")
+		logger.Debug("successfully applied listener middlewares")
 	}
 
-	dialer := net.Dialer{LocalAddr: saddr}
-	if saddr != nil {
-		dialer.Control = DialUpstreamControl(saddr.(*net.TCPAddr).Port)
-	}
-	upstreamConn, err := dialer.Dial("tcp", targetAddr)
+	upstreamConn, err := DialUpstream(ctx, saddr, targetPort)
 	if err != nil {
 		logger.Debug("failed to establish upstream connection", zap.Error(err), zap.Bool("dropConnection", true))
 		return
 	}
+	logger = logger.With(zap.String("targetAddr", upstreamConn.RemoteAddr().String()))
 
 	defer upstreamConn.Close()
 	if Opts.Verbose > 1 {
 		logger.Debug("successfully established upstream connection")
 	}
 
-	if err := conn.(*net.TCPConn).SetNoDelay(true); err != nil {
-		logger.Debug("failed to set nodelay on downstream connection", zap.Error(err), zap.Bool("dropConnection", true))
-	} else if Opts.Verbose > 1 {
-		logger.Debug("successfully set NoDelay on downstream connection")
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(true); err != nil {
+			logger.Debug("failed to set nodelay on downstream connection", zap.Error(err), zap.Bool("dropConnection", true))
+		} else if Opts.Verbose > 1 {
+			logger.Debug("successfully set NoDelay on downstream connection")
+		}
 	}
 
-	if err := upstreamConn.(*net.TCPConn).SetNoDelay(true); err != nil {
-		logger.Debug("failed to set nodelay on upstream connection", zap.Error(err), zap.Bool("dropConnection", true))
-	} else if Opts.Verbose > 1 {
-		logger.Debug("successfully set NoDelay on upstream connection")
+	if tcpConn, ok := upstreamConn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(true); err != nil {
+			logger.Debug("failed to set nodelay on upstream connection", zap.Error(err), zap.Bool("dropConnection", true))
+		} else if Opts.Verbose > 1 {
+			logger.Debug("successfully set NoDelay on upstream connection")
+		}
 	}
 
-	for len(restBytes) > 0 {
-		n, err := upstreamConn.Write(restBytes)
+	switch Opts.UpstreamProxyProtocol {
+	case UpstreamProxyProtocolPassthrough:
+		if err := writeAll(upstreamConn, meta.ProxyHeader); err != nil {
+			logger.Debug("failed to write PROXY header to upstream connection",
+				zap.Error(err), zap.Bool("dropConnection", true))
+			return
+		}
+	case UpstreamProxyProtocolRewrite:
+		// saddr is nil for a PROXY v1 UNKNOWN/v2 LOCAL connection, and
+		// whenever ForwardedMiddleware found no Forwarded/X-Forwarded-For
+		// header; there is no source address to rewrite a header from, so
+		// drop the connection rather than panic the type assertion below.
+		saddrTCP, ok := saddr.(*net.TCPAddr)
+		if !ok {
+			logger.Debug("cannot rewrite PROXY header: no source address available",
+				zap.Bool("dropConnection", true))
+			return
+		}
+		rewritten, err := BuildProxyV2Header(saddrTCP, upstreamConn.RemoteAddr().(*net.TCPAddr), tlvs)
 		if err != nil {
-			logger.Debug("failed to write data to upstream connection",
+			logger.Debug("failed to build PROXY header for upstream connection",
+				zap.Error(err), zap.Bool("dropConnection", true))
+			return
+		}
+		if err := writeAll(upstreamConn, rewritten); err != nil {
+			logger.Debug("failed to write PROXY header to upstream connection",
 				zap.Error(err), zap.Bool("dropConnection", true))
 			return
 		}
-		restBytes = restBytes[n:]
 	}
 
-	PutBuffer(buffer)
-	buffer = nil
-
 	outErr := make(chan error, 2)
-	go tcpCopyData(upstreamConn, conn, outErr)
-	go tcpCopyData(conn, upstreamConn, outErr)
+	go tcpCopyData(upstreamConn, wrapped, "upstream", outErr)
+	go tcpCopyData(wrapped, upstreamConn, "downstream", outErr)
 
 	err = <-outErr
 	if err != nil {
 		logger.Debug("connection broken", zap.Error(err), zap.Bool("dropConnection", true))
-	} else if Opts.Verbose > 1 {
-		logger.Debug("connection closing")
+	} else {
+		result = "ok"
+		if Opts.Verbose > 1 {
+			logger.Debug("connection closing")
+		}
 	}
 }
 
-func TCPListen(listenConfig *net.ListenConfig, logger *zap.Logger, errors chan<- error) {
-	ctx := context.Background()
+// acceptedConn pairs an accepted connection with the PortMapping, listen
+// port and middleware chain of the listener that produced it, so the
+// target address and wire protocol can be resolved without re-parsing any
+// address strings or re-deriving the listener's configuration.
+type acceptedConn struct {
+	conn        net.Conn
+	mapping     PortMapping
+	listenPort  int
+	middlewares []ConnMiddleware
+}
+
+// TCPListen binds a listener for every port covered by Opts.PortMappings
+// (relayed with defaultMiddlewares) plus one listener per entry in
+// Opts.Listeners (each with the middleware chain its -listener flag
+// requested), and relays accepted connections to the upstream target port
+// computed from the mapping that produced them. Listening stops, and
+// tcpHandleConnection goroutines are unblocked, when server's context is
+// canceled via server.Shutdown.
+func TCPListen(server *Server, listenConfig *net.ListenConfig, logger *zap.Logger, errors chan<- error) {
+	ctx := server.Context()
 
-	conns := make(chan net.Conn)
+	conns := make(chan acceptedConn)
 	errs := make(chan error)
 
-	for port := Opts.StartPort; port < Opts.EndPort; port++ {
+	bind := func(port int, mapping PortMapping, middlewares []ConnMiddleware) {
 		go func() {
-			ln, err := listenConfig.Listen(ctx, "tcp", Opts.ListenAddr + ":" + strconv.Itoa(port))
+			ln, err := listenConfig.Listen(ctx, "tcp", Opts.ListenAddr+":"+strconv.Itoa(port))
 			if err != nil {
 				logger.Error("failed to bind listener", zap.Error(err))
 				errors <- err
 				return
 			}
+			server.trackListener(ln)
 
 			for {
 				conn, err := ln.Accept()
-				conns <- conn
-				errs <- err
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					errs <- err
+					return
+				}
+				// conns is unbuffered, so without this select a shutdown
+				// racing this send could leave it blocked forever: the
+				// consumer loop below is also selecting on ctx.Done() and is
+				// free to take that case instead, never reading from conns
+				// again and leaking this goroutine and conn's fd.
+				select {
+				case conns <- acceptedConn{conn: conn, mapping: mapping, listenPort: port, middlewares: middlewares}:
+				case <-ctx.Done():
+					conn.Close()
+					return
+				}
 			}
 		}()
 	}
 
+	for _, mapping := range Opts.PortMappings {
+		for port := mapping.ListenStart; port <= mapping.ListenEnd; port++ {
+			bind(port, mapping, defaultMiddlewares)
+		}
+	}
+
+	for _, spec := range Opts.Listeners {
+		middlewares, err := BuildMiddlewareChain(spec)
+		if err != nil {
+			logger.Error("failed to configure listener", zap.Error(err))
+			errors <- err
+			continue
+		}
+		bind(spec.Port, PortMapping{ListenStart: spec.Port, ListenEnd: spec.Port, TargetStart: spec.Port, TargetEnd: spec.Port}, middlewares)
+	}
+
 	logger.Info("listening")
 
 	go func() {
-		for {
-			err := <- errs
-			if err != nil {
-				logger.Error("failed to accept new connection", zap.Error(err))
-				errors <- err
-				return
-			}
+		for err := range errs {
+			logger.Error("failed to accept new connection", zap.Error(err))
+			errors <- err
 		}
 	}()
 
 	for {
-		conn := <- conns
-
-		go tcpHandleConnection(conn, logger)
+		select {
+		case accepted := <-conns:
+			server.handle(accepted.conn, func(ctx context.Context) {
+				tcpHandleConnection(ctx, accepted.conn, logger, accepted.mapping, accepted.listenPort, accepted.middlewares)
+			})
+		case <-ctx.Done():
+			return
+		}
 	}
 }
@@ -0,0 +1,205 @@
+// Copyright 2019 Path Network, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Metadata carries whatever a ConnMiddleware learned about the true client
+// of a connection: its source/destination address and any PROXY protocol
+// TLVs, to be used in place of values tcpHandleConnection would otherwise
+// derive from SO_IP_TRANSPARENT plus a raw PROXY header.
+type Metadata struct {
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	TLVs       []TLV
+
+	// ProxyHeader holds the raw bytes of a parsed PROXY protocol header,
+	// for UpstreamProxyProtocolPassthrough to re-emit verbatim.
+	ProxyHeader []byte
+}
+
+// ConnMiddleware wraps a freshly accepted connection, peeling off and
+// interpreting one layer of the wire protocol (PROXY header, TLS, an L7
+// CDN's Forwarded headers, ...) and handing back a net.Conn positioned
+// right after that layer plus whatever Metadata it learned. Middlewares are
+// chained, each receiving the conn returned by the previous one, mirroring
+// how obfs4proxy composes pluggable transports.
+type ConnMiddleware interface {
+	Wrap(conn net.Conn) (net.Conn, Metadata, error)
+}
+
+// ApplyMiddlewares runs conn through chain in order, merging each stage's
+// Metadata into the result (a later stage's non-zero fields win).
+func ApplyMiddlewares(conn net.Conn, chain []ConnMiddleware) (net.Conn, Metadata, error) {
+	var meta Metadata
+	for _, mw := range chain {
+		var stageMeta Metadata
+		var err error
+		conn, stageMeta, err = mw.Wrap(conn)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if stageMeta.SourceAddr != nil {
+			meta.SourceAddr = stageMeta.SourceAddr
+		}
+		if stageMeta.DestAddr != nil {
+			meta.DestAddr = stageMeta.DestAddr
+		}
+		if stageMeta.TLVs != nil {
+			meta.TLVs = stageMeta.TLVs
+		}
+		if stageMeta.ProxyHeader != nil {
+			meta.ProxyHeader = stageMeta.ProxyHeader
+		}
+	}
+	return conn, meta, nil
+}
+
+// prefixConn is a net.Conn that replays a buffered prefix before resuming
+// reads from the wrapped connection, used by middlewares that must consume
+// bytes off the wire (to find a header or a request line) without losing
+// the remainder of what they read.
+type prefixConn struct {
+	net.Conn
+	prefix *bufio.Reader
+}
+
+func newPrefixConn(conn net.Conn, leftover []byte) net.Conn {
+	if len(leftover) == 0 {
+		return conn
+	}
+	return &prefixConn{Conn: conn, prefix: bufio.NewReader(io.MultiReader(bytes.NewReader(leftover), conn))}
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.prefix.Read(p)
+}
+
+// ProxyProtocolMiddleware parses a PROXY protocol v1/v2 header (the
+// behavior tcpHandleConnection always had before middlewares existed) and
+// returns a conn with any trailing payload still readable.
+type ProxyProtocolMiddleware struct{}
+
+func (ProxyProtocolMiddleware) Wrap(conn net.Conn) (net.Conn, Metadata, error) {
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, Metadata{}, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	saddr, _, restBytes, tlvs, err := PROXYReadRemoteAddr(buffer[:n], TCP)
+	if err != nil {
+		incProxyHeaderParseError("parse")
+		return nil, Metadata{}, fmt.Errorf("failed to parse PROXY header: %w", err)
+	}
+	header := make([]byte, n-len(restBytes))
+	copy(header, buffer[:len(header)])
+
+	// restBytes aliases buffer, which the deferred PutBuffer above returns
+	// to the pool as soon as Wrap returns -- long before newPrefixConn's
+	// caller actually reads the prefix back out. Copy it to its own
+	// backing array so it survives after the pooled buffer is reused.
+	rest := make([]byte, len(restBytes))
+	copy(rest, restBytes)
+
+	return newPrefixConn(conn, rest), Metadata{SourceAddr: saddr, TLVs: tlvs, ProxyHeader: header}, nil
+}
+
+// TLSMiddleware terminates TLS on the accepted connection, handing inner
+// middlewares (typically ProxyProtocolMiddleware, for haproxy's
+// TLS-with-PP2 listeners) the cleartext stream.
+type TLSMiddleware struct {
+	Config *tls.Config
+}
+
+func (m TLSMiddleware) Wrap(conn net.Conn) (net.Conn, Metadata, error) {
+	tlsConn := tls.Server(conn, m.Config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, Metadata{}, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, Metadata{}, nil
+}
+
+// ForwardedMiddleware reads a single HTTP/1.1 request line and headers and
+// synthesizes Metadata.SourceAddr from the Forwarded or X-Forwarded-For
+// header, for backends sitting behind an L7 CDN/load balancer that mmproxy
+// itself sits behind. The request (line, headers and any already-buffered
+// body bytes) is replayed to the upstream byte-for-byte as received.
+type ForwardedMiddleware struct{}
+
+func (ForwardedMiddleware) Wrap(conn net.Conn) (net.Conn, Metadata, error) {
+	// raw accumulates every byte bufio.Reader pulls from conn, which is more
+	// than http.ReadRequest consumes for the request line and headers: a
+	// bufio fill reads a whole buffer's worth at a time, so it also captures
+	// any body/pipelined bytes that land in the same read. That makes raw
+	// exactly the replay we want without separately tracking what's left
+	// buffered. http.Request.Write is not an option here: it's a client-side
+	// serializer that fabricates a default User-Agent when one wasn't sent
+	// and doesn't preserve header order, so it can hand the upstream headers
+	// the client never sent.
+	var raw bytes.Buffer
+	reader := bufio.NewReader(io.TeeReader(conn, &raw))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, Metadata{}, fmt.Errorf("failed to read HTTP request: %w", err)
+	}
+
+	saddr := parseForwardedFor(req.Header)
+
+	replay := make([]byte, raw.Len())
+	copy(replay, raw.Bytes())
+
+	return newPrefixConn(conn, replay), Metadata{SourceAddr: saddr}, nil
+}
+
+// parseForwardedFor extracts a client address from, in order of preference,
+// the standardized Forwarded header (RFC 7239) and the de facto
+// X-Forwarded-For header, returning nil if neither is present or parseable.
+func parseForwardedFor(h http.Header) net.Addr {
+	if fwd := h.Get("Forwarded"); fwd != "" {
+		for _, part := range strings.Split(fwd, ";") {
+			part = strings.TrimSpace(part)
+			if ip, ok := strings.CutPrefix(part, "for="); ok {
+				if addr := parseForwardedAddr(strings.Trim(ip, `"`)); addr != nil {
+					return addr
+				}
+			}
+		}
+	}
+
+	if xff := h.Get("X-Forwarded-For"); xff != "" {
+		first := strings.TrimSpace(strings.Split(xff, ",")[0])
+		if addr := parseForwardedAddr(first); addr != nil {
+			return addr
+		}
+	}
+
+	return nil
+}
+
+func parseForwardedAddr(s string) net.Addr {
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+	if ip := net.ParseIP(s); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return &net.TCPAddr{IP: ip}
+		}
+	}
+	return nil
+}